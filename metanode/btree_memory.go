@@ -17,6 +17,7 @@ package metanode
 import (
 	"github.com/chubaofs/chubaofs/util/btree"
 	"sync"
+	"sync/atomic"
 )
 
 const defaultBTreeDegree = 32
@@ -101,69 +102,359 @@ func (i *MultipartBTree) Get(key, id string) (*Multipart, error) {
 //put
 func (i *InodeBTree) Put(inode *Inode) error {
 	i.BTree.ReplaceOrInsert(inode, true)
-	return nil
+	return i.appendWAL(walOpPut, inode)
 }
 func (i *DentryBTree) Put(dentry *Dentry) error {
 	i.BTree.ReplaceOrInsert(dentry, true)
-	return nil
+	return i.appendWAL(walOpPut, dentry)
 }
 func (i *ExtendBTree) Put(extend *Extend) error {
 	i.BTree.ReplaceOrInsert(extend, true)
-	return nil
+	return i.appendWAL(walOpPut, extend)
 }
 func (i *MultipartBTree) Put(multipart *Multipart) error {
 	i.BTree.ReplaceOrInsert(multipart, true)
-	return nil
+	return i.appendWAL(walOpPut, multipart)
 }
 
 //create
 func (i *InodeBTree) Create(inode *Inode) error {
 	_, ok := i.BTree.ReplaceOrInsert(inode, false)
-	if ok {
-		return nil
+	if !ok {
+		return existsError
 	}
-	return existsError
+	return i.appendWAL(walOpPut, inode)
 }
 func (i *DentryBTree) Create(dentry *Dentry) error {
 	_, ok := i.BTree.ReplaceOrInsert(dentry, false)
-	if ok {
-		return nil
+	if !ok {
+		return existsError
 	}
-	return existsError
+	return i.appendWAL(walOpPut, dentry)
 }
 func (i *ExtendBTree) Create(extend *Extend) error {
 	_, ok := i.BTree.ReplaceOrInsert(extend, false)
-	if ok {
-		return nil
+	if !ok {
+		return existsError
 	}
-	return existsError
+	return i.appendWAL(walOpPut, extend)
 }
 func (i *MultipartBTree) Create(mul *Multipart) error {
 	_, ok := i.BTree.ReplaceOrInsert(mul, false)
-	if ok {
-		return nil
+	if !ok {
+		return existsError
 	}
-	return existsError
+	return i.appendWAL(walOpPut, mul)
 }
 
 //delete
 func (i *InodeBTree) Delete(ino uint64) error {
-	i.BTree.Delete(&Inode{Inode: ino})
-	return nil
+	key := &Inode{Inode: ino}
+	i.BTree.Delete(key)
+	return i.appendWAL(walOpDelete, key)
 }
 func (i *DentryBTree) Delete(pid uint64, name string) error {
-	i.BTree.Delete(&Dentry{ParentId: pid, Name: name})
-	return nil
+	key := &Dentry{ParentId: pid, Name: name}
+	i.BTree.Delete(key)
+	return i.appendWAL(walOpDelete, key)
 }
 func (i *ExtendBTree) Delete(ino uint64) error {
-	i.BTree.Delete(&Extend{inode: ino})
-	return nil
+	key := &Extend{inode: ino}
+	i.BTree.Delete(key)
+	return i.appendWAL(walOpDelete, key)
 }
 func (i *MultipartBTree) Delete(key, id string) error {
-	i.BTree.Delete(&Multipart{key: key, id: id})
+	k := &Multipart{key: key, id: id}
+	i.BTree.Delete(k)
+	return i.appendWAL(walOpDelete, k)
+}
+
+// appendWAL records a mutation of inode in the WAL, keyed by the tree's
+// current ApplyID. It is a no-op when the tree is memory-only.
+func (i *InodeBTree) appendWAL(op walOp, inode *Inode) error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	data, err := inode.Marshal()
+	if err != nil {
+		return err
+	}
+	return i.BTree.wal.append(i.BTree.ApplyID(), op, data)
+}
+
+func (i *DentryBTree) appendWAL(op walOp, dentry *Dentry) error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	data, err := dentry.Marshal()
+	if err != nil {
+		return err
+	}
+	return i.BTree.wal.append(i.BTree.ApplyID(), op, data)
+}
+
+func (i *ExtendBTree) appendWAL(op walOp, extend *Extend) error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	data, err := extend.Bytes()
+	if err != nil {
+		return err
+	}
+	return i.BTree.wal.append(i.BTree.ApplyID(), op, data)
+}
+
+func (i *MultipartBTree) appendWAL(op walOp, mul *Multipart) error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	data, err := mul.Bytes()
+	if err != nil {
+		return err
+	}
+	return i.BTree.wal.append(i.BTree.ApplyID(), op, data)
+}
+
+// LoadWAL puts the tree into persistent mode: it replays the newest
+// checkpoint under dir followed by any WAL entries committed after it, then
+// leaves the WAL open so subsequent Put/Create/Delete calls are logged.
+// Replay goes through ReplaceOrInsert/Delete rather than touching the
+// embedded btree.BTree directly, so any secondary indexes registered by
+// NewInodeBTree are rebuilt along with the tree instead of coming back
+// empty. The tree's ApplyID ends up at the highest ApplyID actually
+// replayed (checkpoint or trailing WAL, whichever is newer), not just the
+// checkpoint's, so callers comparing against it - like
+// Store.ReplayTxnLog - see the tree's true as-of point.
+func (i *InodeBTree) LoadWAL(dir string) error {
+	applyID, err := replayCheckpoint(dir, InodeType, func(op walOp, data []byte) error {
+		inode := &Inode{}
+		if err := inode.Unmarshal(data); err != nil {
+			return err
+		}
+		i.BTree.ReplaceOrInsert(inode, true)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if applyID, err = replayWAL(dir, InodeType, applyID, func(op walOp, data []byte) error {
+		inode := &Inode{}
+		if err := inode.Unmarshal(data); err != nil {
+			return err
+		}
+		if op == walOpDelete {
+			i.BTree.Delete(inode)
+		} else {
+			i.BTree.ReplaceOrInsert(inode, true)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	w, err := openWAL(dir, InodeType)
+	if err != nil {
+		return err
+	}
+	w.checkpointFn = i.Checkpoint
+	i.BTree.wal = w
+	i.BTree.SetApplyID(applyID)
+	return nil
+}
+
+// Checkpoint snapshots the tree and its ApplyID together and persists the
+// snapshot as a new checkpoint file, allowing the WAL entries it covers to
+// be compacted away.
+func (i *InodeBTree) Checkpoint() error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	tree, applyID := i.BTree.snapshotWithApplyID()
+	return i.BTree.wal.checkpoint(applyID, func(cb func(data []byte) error) error {
+		var rerr error
+		tree.Ascend(func(bi BtreeItem) bool {
+			data, err := bi.(*Inode).Marshal()
+			if err != nil {
+				rerr = err
+				return false
+			}
+			rerr = cb(data)
+			return rerr == nil
+		})
+		return rerr
+	})
+}
+
+// LoadWAL puts the tree into persistent mode; see InodeBTree.LoadWAL for why
+// replay goes through ReplaceOrInsert/Delete instead of the embedded
+// btree.BTree directly.
+func (i *DentryBTree) LoadWAL(dir string) error {
+	applyID, err := replayCheckpoint(dir, DentryType, func(op walOp, data []byte) error {
+		dentry := &Dentry{}
+		if err := dentry.Unmarshal(data); err != nil {
+			return err
+		}
+		i.BTree.ReplaceOrInsert(dentry, true)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if applyID, err = replayWAL(dir, DentryType, applyID, func(op walOp, data []byte) error {
+		dentry := &Dentry{}
+		if err := dentry.Unmarshal(data); err != nil {
+			return err
+		}
+		if op == walOpDelete {
+			i.BTree.Delete(dentry)
+		} else {
+			i.BTree.ReplaceOrInsert(dentry, true)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	w, err := openWAL(dir, DentryType)
+	if err != nil {
+		return err
+	}
+	w.checkpointFn = i.Checkpoint
+	i.BTree.wal = w
+	i.BTree.SetApplyID(applyID)
+	return nil
+}
+
+func (i *DentryBTree) Checkpoint() error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	tree, applyID := i.BTree.snapshotWithApplyID()
+	return i.BTree.wal.checkpoint(applyID, func(cb func(data []byte) error) error {
+		var rerr error
+		tree.Ascend(func(bi BtreeItem) bool {
+			data, err := bi.(*Dentry).Marshal()
+			if err != nil {
+				rerr = err
+				return false
+			}
+			rerr = cb(data)
+			return rerr == nil
+		})
+		return rerr
+	})
+}
+
+// LoadWAL puts the tree into persistent mode; see InodeBTree.LoadWAL for why
+// replay goes through ReplaceOrInsert/Delete instead of the embedded
+// btree.BTree directly.
+func (i *ExtendBTree) LoadWAL(dir string) error {
+	applyID, err := replayCheckpoint(dir, ExtendType, func(op walOp, data []byte) error {
+		extend, err := NewExtendFromBytes(data)
+		if err != nil {
+			return err
+		}
+		i.BTree.ReplaceOrInsert(extend, true)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if applyID, err = replayWAL(dir, ExtendType, applyID, func(op walOp, data []byte) error {
+		extend, err := NewExtendFromBytes(data)
+		if err != nil {
+			return err
+		}
+		if op == walOpDelete {
+			i.BTree.Delete(extend)
+		} else {
+			i.BTree.ReplaceOrInsert(extend, true)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	w, err := openWAL(dir, ExtendType)
+	if err != nil {
+		return err
+	}
+	w.checkpointFn = i.Checkpoint
+	i.BTree.wal = w
+	i.BTree.SetApplyID(applyID)
+	return nil
+}
+
+func (i *ExtendBTree) Checkpoint() error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	tree, applyID := i.BTree.snapshotWithApplyID()
+	return i.BTree.wal.checkpoint(applyID, func(cb func(data []byte) error) error {
+		var rerr error
+		tree.Ascend(func(bi BtreeItem) bool {
+			data, err := bi.(*Extend).Bytes()
+			if err != nil {
+				rerr = err
+				return false
+			}
+			rerr = cb(data)
+			return rerr == nil
+		})
+		return rerr
+	})
+}
+
+// LoadWAL puts the tree into persistent mode; see InodeBTree.LoadWAL for why
+// replay goes through ReplaceOrInsert/Delete instead of the embedded
+// btree.BTree directly.
+func (i *MultipartBTree) LoadWAL(dir string) error {
+	applyID, err := replayCheckpoint(dir, MultipartType, func(op walOp, data []byte) error {
+		mul := MultipartFromBytes(data)
+		i.BTree.ReplaceOrInsert(mul, true)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if applyID, err = replayWAL(dir, MultipartType, applyID, func(op walOp, data []byte) error {
+		mul := MultipartFromBytes(data)
+		if op == walOpDelete {
+			i.BTree.Delete(mul)
+		} else {
+			i.BTree.ReplaceOrInsert(mul, true)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	w, err := openWAL(dir, MultipartType)
+	if err != nil {
+		return err
+	}
+	w.checkpointFn = i.Checkpoint
+	i.BTree.wal = w
+	i.BTree.SetApplyID(applyID)
 	return nil
 }
 
+func (i *MultipartBTree) Checkpoint() error {
+	if i.BTree.wal == nil {
+		return nil
+	}
+	tree, applyID := i.BTree.snapshotWithApplyID()
+	return i.BTree.wal.checkpoint(applyID, func(cb func(data []byte) error) error {
+		var rerr error
+		tree.Ascend(func(bi BtreeItem) bool {
+			data, err := bi.(*Multipart).Bytes()
+			if err != nil {
+				rerr = err
+				return false
+			}
+			rerr = cb(data)
+			return rerr == nil
+		})
+		return rerr
+	})
+}
+
 //range
 func (i *InodeBTree) Range(start, end *Inode, cb func(v []byte) (bool, error)) error {
 	var (
@@ -272,10 +563,34 @@ func (i *MultipartBTree) Range(start, end *Multipart, cb func(v []byte) (bool, e
 // BTree is the wrapper of Google's btree.
 type BTree struct {
 	sync.RWMutex
-	tree *btree.BTree
-}
-
-// NewBtree creates a new btree.
+	tree    *btree.BTree
+	wal     *wal   // nil unless the tree was opened in persistent mode
+	applyID uint64 // last raft ApplyID applied to this tree, atomic
+	indexes map[string]*Index
+
+	// changeLogOn, generation and changeLog back changesSince; see
+	// EnableChangeLog. They cost nothing when changeLogOn is left false.
+	changeLogOn bool
+	generation  uint64
+	changeLog   []changeEntry
+}
+
+// changeLogCapacity bounds how many of the most recent mutations a BTree
+// remembers once EnableChangeLog is on. Once more mutations than this have
+// happened since the generation a caller wants to diff from, changesSince
+// can no longer answer and reports ok=false.
+const changeLogCapacity = 4096
+
+// changeEntry is one recorded mutation: the generation it happened at and
+// the item's key, so a caller can look that key up in two snapshots to tell
+// Added from Changed from Removed without rescanning either tree.
+type changeEntry struct {
+	generation uint64
+	key        BtreeItem
+}
+
+// NewBtree creates a new btree. The tree is memory-only until a wrapper type
+// (InodeBTree, DentryBTree, ...) opens it in persistent mode with LoadWAL.
 func NewBtree() *BTree {
 	return &BTree{
 		tree: btree.New(defaultBTreeDegree),
@@ -323,26 +638,52 @@ func (b *BTree) Has(key BtreeItem) (ok bool) {
 	return
 }
 
-// Delete deletes the object by the given key.
+// Delete deletes the object by the given key, dropping it from any
+// registered indexes under the same lock.
 func (b *BTree) Delete(key BtreeItem) (item BtreeItem) {
 	b.Lock()
-	item = b.tree.Delete(key)
+	item = b.deleteLocked(key)
 	b.Unlock()
 	return
 }
 
+// deleteLocked is Delete's body for callers that already hold b's write lock.
+func (b *BTree) deleteLocked(key BtreeItem) (item BtreeItem) {
+	item = b.tree.Delete(key)
+	if item != nil {
+		b.removeFromIndexesLocked(item)
+		b.recordChangeLocked(key)
+	}
+	return
+}
+
 func (b *BTree) Execute(fn func(tree *btree.BTree) interface{}) interface{} {
 	b.Lock()
 	defer b.Unlock()
 	return fn(b.tree)
 }
 
-// ReplaceOrInsert is the wrapper of google's btree ReplaceOrInsert.
+// ReplaceOrInsert is the wrapper of google's btree ReplaceOrInsert. Any
+// indexes registered via RegisterIndex are relocated under the same lock.
 func (b *BTree) ReplaceOrInsert(key BtreeItem, replace bool) (item BtreeItem, ok bool) {
 	b.Lock()
+	item, ok = b.replaceOrInsertLocked(key, replace)
+	b.Unlock()
+	return
+}
+
+// replaceOrInsertLocked is ReplaceOrInsert's body, split out so callers that
+// already hold b's write lock (such as a Txn commit applying several trees'
+// staged mutations under one fixed lock order) can reuse it without
+// recursively locking b.
+func (b *BTree) replaceOrInsertLocked(key BtreeItem, replace bool) (item BtreeItem, ok bool) {
 	if replace {
 		item = b.tree.ReplaceOrInsert(key)
-		b.Unlock()
+		if item != nil {
+			b.removeFromIndexesLocked(item)
+		}
+		b.updateIndexesLocked(key)
+		b.recordChangeLocked(key)
 		ok = true
 		return
 	}
@@ -350,15 +691,82 @@ func (b *BTree) ReplaceOrInsert(key BtreeItem, replace bool) (item BtreeItem, ok
 	item = b.tree.Get(key)
 	if item == nil {
 		item = b.tree.ReplaceOrInsert(key)
-		b.Unlock()
+		b.updateIndexesLocked(key)
+		b.recordChangeLocked(key)
 		ok = true
 		return
 	}
 	ok = false
-	b.Unlock()
 	return
 }
 
+// EnableChangeLog turns on per-mutation generation tracking: every
+// ReplaceOrInsert/Delete bumps the tree's generation and, as long as fewer
+// than changeLogCapacity mutations have happened since, remembers which key
+// changed. This is what lets changesSince answer "what changed between
+// generation A and B" without scanning the whole tree. A tree that never
+// calls this pays no bookkeeping cost, and changesSince always reports
+// ok=false for it.
+func (b *BTree) EnableChangeLog() {
+	b.Lock()
+	b.changeLogOn = true
+	b.Unlock()
+}
+
+// Generation returns the number of mutations recorded since EnableChangeLog
+// was called (0 if it never was, or none have happened yet).
+func (b *BTree) Generation() uint64 {
+	b.RLock()
+	defer b.RUnlock()
+	return b.generation
+}
+
+// recordChangeLocked bumps the tree's generation and, if change-log
+// tracking is enabled, appends key to the change log, evicting the oldest
+// entry once it is at capacity. Callers must already hold b's write lock.
+func (b *BTree) recordChangeLocked(key BtreeItem) {
+	if !b.changeLogOn {
+		return
+	}
+	b.generation++
+	if len(b.changeLog) >= changeLogCapacity {
+		b.changeLog = b.changeLog[1:]
+	}
+	b.changeLog = append(b.changeLog, changeEntry{generation: b.generation, key: key})
+}
+
+// changesSince returns the keys mutated with generation in (oldGen, newGen],
+// deduplicated and in ascending key order, or ok=false if the change log
+// can't answer that - change-log tracking was never enabled, or more than
+// changeLogCapacity mutations have happened since oldGen, aging the
+// relevant entries out of the log. Callers must fall back to a full scan
+// when ok is false.
+func (b *BTree) changesSince(oldGen, newGen uint64) (keys []BtreeItem, ok bool) {
+	b.RLock()
+	defer b.RUnlock()
+	if !b.changeLogOn || oldGen > newGen {
+		return nil, false
+	}
+	if oldGen == newGen {
+		return nil, true
+	}
+	if len(b.changeLog) == 0 || b.changeLog[0].generation > oldGen+1 {
+		return nil, false
+	}
+	dedup := btree.New(defaultBTreeDegree)
+	for _, e := range b.changeLog {
+		if e.generation <= oldGen || e.generation > newGen {
+			continue
+		}
+		dedup.ReplaceOrInsert(e.key)
+	}
+	dedup.Ascend(func(i btree.Item) bool {
+		keys = append(keys, i.(BtreeItem))
+		return true
+	})
+	return keys, true
+}
+
 // Ascend is the wrapper of the google's btree Ascend.
 // This function scans the entire btree. When the data is huge, it is not recommended to use this function online.
 // Instead, it is recommended to call GetTree to obtain the snapshot of the current btree, and then do the scan on the snapshot.
@@ -382,16 +790,73 @@ func (b *BTree) AscendGreaterOrEqual(pivot BtreeItem, iterator func(i BtreeItem)
 	b.RUnlock()
 }
 
-// GetTree returns the snapshot of a btree.
+// Descend is the wrapper of the google's btree Descend.
+func (b *BTree) Descend(fn func(i BtreeItem) bool) {
+	b.RLock()
+	b.tree.Descend(fn)
+	b.RUnlock()
+}
+
+// DescendRange is the wrapper of the google's btree DescendRange: it visits
+// every item in the range (greaterThan, lessOrEqual], in descending order.
+func (b *BTree) DescendRange(lessOrEqual, greaterThan BtreeItem, iterator func(i BtreeItem) bool) {
+	b.RLock()
+	b.tree.DescendRange(lessOrEqual, greaterThan, iterator)
+	b.RUnlock()
+}
+
+// GetTree returns the snapshot of a btree, including its registered
+// secondary indexes, so AscendIndex/DescendIndex keep working against the
+// snapshot instead of panicking with "unknown index".
 func (b *BTree) GetTree() *BTree {
-	b.Lock()
-	t := b.tree.Clone()
-	b.Unlock()
+	t, indexes, _, _ := b.snapshotStateWithApplyID()
 	nb := NewBtree()
 	nb.tree = t
+	nb.indexes = indexes
 	return nb
 }
 
+// Snapshot is GetTree plus the generation the clone was taken at, for a
+// caller like SnapshotManager that needs to line a snapshot up with a later
+// changesSince call. generation is 0 if EnableChangeLog was never called.
+func (b *BTree) Snapshot() (snap *BTree, generation uint64) {
+	t, indexes, _, generation := b.snapshotStateWithApplyID()
+	snap = NewBtree()
+	snap.tree = t
+	snap.indexes = indexes
+	return
+}
+
+// snapshotWithApplyID clones the tree and reads its ApplyID in the same
+// critical section, so a checkpoint's dumped data and the ApplyID it is
+// stamped with always describe the same point in the mutation stream.
+// Reading them as two separate, unlocked steps would let a concurrent
+// ReplaceOrInsert/Delete land in between and make the checkpoint's recorded
+// ApplyID newer than the data it actually contains.
+func (b *BTree) snapshotWithApplyID() (tree *btree.BTree, applyID uint64) {
+	tree, _, applyID, _ = b.snapshotStateWithApplyID()
+	return
+}
+
+// snapshotStateWithApplyID clones the tree and its registered indexes and
+// reads the ApplyID and generation, all under one lock, so a caller that
+// needs more than one of them never sees them describe different points in
+// the mutation stream.
+func (b *BTree) snapshotStateWithApplyID() (tree *btree.BTree, indexes map[string]*Index, applyID uint64, generation uint64) {
+	b.Lock()
+	tree = b.tree.Clone()
+	if b.indexes != nil {
+		indexes = make(map[string]*Index, len(b.indexes))
+		for name, idx := range b.indexes {
+			indexes[name] = idx.Clone()
+		}
+	}
+	applyID = atomic.LoadUint64(&b.applyID)
+	generation = b.generation
+	b.Unlock()
+	return
+}
+
 // Reset resets the current btree.
 func (b *BTree) Reset() {
 	b.Lock()
@@ -403,11 +868,38 @@ func (i *BTree) Release() {
 	i.Reset()
 }
 
+// SetApplyID records the raft index the current tree state corresponds to,
+// so a crash recovery replay of the WAL knows where to resume from and
+// applies each entry at most once. Correctness of checkpoint/compaction
+// depends on the caller advancing this to the entry's own index before (or
+// atomically with) applying that entry's mutation; this package does not
+// itself drive that per-mutation advance, so a caller that never calls
+// SetApplyID between mutations will see every WAL record share one ApplyID
+// and checkpoint compaction degrade to discarding the whole log, same as
+// before compaction was added, just at higher I/O cost.
 func (i *BTree) SetApplyID(index uint64) {
+	atomic.StoreUint64(&i.applyID, index)
 }
 
+// ApplyID returns the last ApplyID recorded via SetApplyID.
+func (i *BTree) ApplyID() uint64 {
+	return atomic.LoadUint64(&i.applyID)
+}
+
+// Flush fsyncs the WAL so every mutation appended so far is durable, and
+// folds the log into a fresh checkpoint once it has grown past
+// checkpointThreshold. It is a no-op on a memory-only tree.
 func (i *BTree) Flush() error {
-	panic("implement me")
+	if i.wal == nil {
+		return nil
+	}
+	if err := i.wal.sync(); err != nil {
+		return err
+	}
+	if i.wal.shouldCheckpoint() {
+		return i.wal.checkpointFn()
+	}
+	return nil
 }
 
 func (i *BTree) Count() uint64 {
@@ -0,0 +1,330 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+// RangeDescend walks the tree in descending key order over the same
+// [start, end) range Range walks ascending: start inclusive, end exclusive.
+// When end is nil it walks every item >= start; google/btree has no
+// descending-from-a-lower-bound primitive, so that case descends the whole
+// tree and stops as soon as an item falls below start, which touches
+// exactly the items >= start, same as the ascending case. When end is
+// non-nil, BTree.DescendRange(end, start) gives (start, end] - the mirror
+// image of [start, end) - so the item equal to end must be skipped and the
+// item equal to start, which DescendRange excludes, must be appended once
+// the range is otherwise exhausted.
+func (i *InodeBTree) RangeDescend(start, end *Inode, cb func(v []byte) (bool, error)) error {
+	var err error
+	stopped := false
+	callback := func(bi BtreeItem) bool {
+		ino := bi.(*Inode)
+		if end != nil && !ino.Less(end) && !end.Less(ino) {
+			return true // equal to end: excluded from [start, end), keep descending
+		}
+		bs, e := ino.Marshal()
+		if e != nil {
+			err = e
+			return false
+		}
+		next, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		if !next {
+			stopped = true
+		}
+		return next
+	}
+
+	if end == nil {
+		i.BTree.Descend(func(bi BtreeItem) bool {
+			if start != nil && bi.(*Inode).Less(start) {
+				return false
+			}
+			return callback(bi)
+		})
+		return err
+	}
+
+	i.BTree.DescendRange(end, start, callback)
+	if err == nil && !stopped && start != nil && start.Less(end) {
+		if item := i.BTree.Get(start); item != nil {
+			callback(item)
+		}
+	}
+	return err
+}
+
+// RangeWithLimit behaves like Range but stops after at most limit items
+// (limit <= 0 means unlimited), returning the key of the next item the
+// caller should resume from so scans can be paged cheaply. next is nil once
+// the scan reaches end or exhausts the tree.
+func (i *InodeBTree) RangeWithLimit(start, end *Inode, limit int, cb func(v []byte) (bool, error)) (next *Inode, err error) {
+	count := 0
+	callback := func(bi BtreeItem) bool {
+		if limit > 0 && count >= limit {
+			next = bi.(*Inode)
+			return false
+		}
+		bs, e := bi.(*Inode).Marshal()
+		if e != nil {
+			err = e
+			return false
+		}
+		more, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		count++
+		return more
+	}
+
+	if end == nil {
+		i.BTree.AscendGreaterOrEqual(start, callback)
+	} else {
+		i.BTree.AscendRange(start, end, callback)
+	}
+	return
+}
+
+// RangeDescend walks the tree in descending key order; see InodeBTree's
+// RangeDescend for the bound semantics.
+func (i *DentryBTree) RangeDescend(start, end *Dentry, cb func(v []byte) (bool, error)) error {
+	var err error
+	stopped := false
+	callback := func(bi BtreeItem) bool {
+		den := bi.(*Dentry)
+		if end != nil && !den.Less(end) && !end.Less(den) {
+			return true // equal to end: excluded from [start, end), keep descending
+		}
+		bs, e := den.Marshal()
+		if e != nil {
+			err = e
+			return false
+		}
+		next, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		if !next {
+			stopped = true
+		}
+		return next
+	}
+
+	if end == nil {
+		i.BTree.Descend(func(bi BtreeItem) bool {
+			if start != nil && bi.(*Dentry).Less(start) {
+				return false
+			}
+			return callback(bi)
+		})
+		return err
+	}
+
+	i.BTree.DescendRange(end, start, callback)
+	if err == nil && !stopped && start != nil && start.Less(end) {
+		if item := i.BTree.Get(start); item != nil {
+			callback(item)
+		}
+	}
+	return err
+}
+
+// RangeWithLimit behaves like Range but stops after at most limit items
+// (limit <= 0 means unlimited), returning the key to resume from.
+func (i *DentryBTree) RangeWithLimit(start, end *Dentry, limit int, cb func(v []byte) (bool, error)) (next *Dentry, err error) {
+	count := 0
+	callback := func(bi BtreeItem) bool {
+		if limit > 0 && count >= limit {
+			next = bi.(*Dentry)
+			return false
+		}
+		bs, e := bi.(*Dentry).Marshal()
+		if e != nil {
+			err = e
+			return false
+		}
+		more, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		count++
+		return more
+	}
+
+	if end == nil {
+		i.BTree.AscendGreaterOrEqual(start, callback)
+	} else {
+		i.BTree.AscendRange(start, end, callback)
+	}
+	return
+}
+
+// RangeDescend walks the tree in descending key order; see InodeBTree's
+// RangeDescend for the bound semantics.
+func (i *ExtendBTree) RangeDescend(start, end *Extend, cb func(v []byte) (bool, error)) error {
+	var err error
+	stopped := false
+	callback := func(bi BtreeItem) bool {
+		ext := bi.(*Extend)
+		if end != nil && !ext.Less(end) && !end.Less(ext) {
+			return true // equal to end: excluded from [start, end), keep descending
+		}
+		bs, e := ext.Bytes()
+		if e != nil {
+			err = e
+			return false
+		}
+		next, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		if !next {
+			stopped = true
+		}
+		return next
+	}
+
+	if end == nil {
+		i.BTree.Descend(func(bi BtreeItem) bool {
+			if start != nil && bi.(*Extend).Less(start) {
+				return false
+			}
+			return callback(bi)
+		})
+		return err
+	}
+
+	i.BTree.DescendRange(end, start, callback)
+	if err == nil && !stopped && start != nil && start.Less(end) {
+		if item := i.BTree.Get(start); item != nil {
+			callback(item)
+		}
+	}
+	return err
+}
+
+// RangeWithLimit behaves like Range but stops after at most limit items
+// (limit <= 0 means unlimited), returning the key to resume from.
+func (i *ExtendBTree) RangeWithLimit(start, end *Extend, limit int, cb func(v []byte) (bool, error)) (next *Extend, err error) {
+	count := 0
+	callback := func(bi BtreeItem) bool {
+		if limit > 0 && count >= limit {
+			next = bi.(*Extend)
+			return false
+		}
+		bs, e := bi.(*Extend).Bytes()
+		if e != nil {
+			err = e
+			return false
+		}
+		more, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		count++
+		return more
+	}
+
+	if end == nil {
+		i.BTree.AscendGreaterOrEqual(start, callback)
+	} else {
+		i.BTree.AscendRange(start, end, callback)
+	}
+	return
+}
+
+// RangeDescend walks the tree in descending key order; see InodeBTree's
+// RangeDescend for the bound semantics.
+func (i *MultipartBTree) RangeDescend(start, end *Multipart, cb func(v []byte) (bool, error)) error {
+	var err error
+	stopped := false
+	callback := func(bi BtreeItem) bool {
+		mul := bi.(*Multipart)
+		if end != nil && !mul.Less(end) && !end.Less(mul) {
+			return true // equal to end: excluded from [start, end), keep descending
+		}
+		bs, e := mul.Bytes()
+		if e != nil {
+			err = e
+			return false
+		}
+		next, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		if !next {
+			stopped = true
+		}
+		return next
+	}
+
+	if end == nil {
+		i.BTree.Descend(func(bi BtreeItem) bool {
+			if start != nil && bi.(*Multipart).Less(start) {
+				return false
+			}
+			return callback(bi)
+		})
+		return err
+	}
+
+	i.BTree.DescendRange(end, start, callback)
+	if err == nil && !stopped && start != nil && start.Less(end) {
+		if item := i.BTree.Get(start); item != nil {
+			callback(item)
+		}
+	}
+	return err
+}
+
+// RangeWithLimit behaves like Range but stops after at most limit items
+// (limit <= 0 means unlimited), returning the key to resume from, which
+// fits a marker-style paging parameter such as S3 ListObjects' marker.
+func (i *MultipartBTree) RangeWithLimit(start, end *Multipart, limit int, cb func(v []byte) (bool, error)) (next *Multipart, err error) {
+	count := 0
+	callback := func(bi BtreeItem) bool {
+		if limit > 0 && count >= limit {
+			next = bi.(*Multipart)
+			return false
+		}
+		bs, e := bi.(*Multipart).Bytes()
+		if e != nil {
+			err = e
+			return false
+		}
+		more, e := cb(bs)
+		if e != nil {
+			err = e
+			return false
+		}
+		count++
+		return more
+	}
+
+	if end == nil {
+		i.BTree.AscendGreaterOrEqual(start, callback)
+	} else {
+		i.BTree.AscendRange(start, end, callback)
+	}
+	return
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import "testing"
+
+func newRangeTestTree(inodes ...uint64) *InodeBTree {
+	t := &InodeBTree{BTree: NewBtree()}
+	for _, ino := range inodes {
+		t.BTree.ReplaceOrInsert(&Inode{Inode: ino}, true)
+	}
+	return t
+}
+
+func collectInodes(t *InodeBTree, start, end *Inode) []uint64 {
+	var got []uint64
+	t.RangeDescend(start, end, func(v []byte) (bool, error) {
+		ino := &Inode{}
+		if err := ino.Unmarshal(v); err != nil {
+			return false, err
+		}
+		got = append(got, ino.Inode)
+		return true, nil
+	})
+	return got
+}
+
+// TestRangeDescendMatchesRangeBounds asserts RangeDescend visits exactly the
+// same [start, end) set as Range, just in reverse order: the item at start
+// must be included and the item at end must not.
+func TestRangeDescendMatchesRangeBounds(t *testing.T) {
+	tree := newRangeTestTree(1, 2, 3, 4, 5)
+	start := &Inode{Inode: 2}
+	end := &Inode{Inode: 5}
+
+	var ascending []uint64
+	tree.Range(start, end, func(v []byte) (bool, error) {
+		ino := &Inode{}
+		if err := ino.Unmarshal(v); err != nil {
+			return false, err
+		}
+		ascending = append(ascending, ino.Inode)
+		return true, nil
+	})
+
+	descending := collectInodes(tree, start, end)
+
+	if len(ascending) != len(descending) {
+		t.Fatalf("Range found %d items, RangeDescend found %d", len(ascending), len(descending))
+	}
+	for i, ino := range ascending {
+		want := descending[len(descending)-1-i]
+		if ino != want {
+			t.Fatalf("mismatch at position %d: Range has %d, RangeDescend (reversed) has %d", i, ino, want)
+		}
+	}
+
+	want := []uint64{2, 3, 4}
+	if len(descending) != len(want) {
+		t.Fatalf("RangeDescend(2, 5) = %v, want %v", descending, want)
+	}
+	for i := range want {
+		if descending[i] != want[len(want)-1-i] {
+			t.Fatalf("RangeDescend(2, 5) = %v, want descending %v", descending, want)
+		}
+	}
+}
+
+// TestRangeDescendNoEndVisitsFromStart covers the end == nil case: every
+// item >= start, descending.
+func TestRangeDescendNoEndVisitsFromStart(t *testing.T) {
+	tree := newRangeTestTree(1, 2, 3, 4, 5)
+	got := collectInodes(tree, &Inode{Inode: 3}, nil)
+	want := []uint64{5, 4, 3}
+	if len(got) != len(want) {
+		t.Fatalf("RangeDescend(3, nil) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("RangeDescend(3, nil) = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestRangeDescendEmptyWhenStartEqualsEnd covers the degenerate [x, x) range,
+// which must be empty just like Range's AscendRange(x, x) is.
+func TestRangeDescendEmptyWhenStartEqualsEnd(t *testing.T) {
+	tree := newRangeTestTree(1, 2, 3)
+	same := &Inode{Inode: 2}
+	got := collectInodes(tree, same, same)
+	if len(got) != 0 {
+		t.Fatalf("RangeDescend(2, 2) = %v, want empty", got)
+	}
+}
+
+func collectInodesWithLimit(t *InodeBTree, start, end *Inode, limit int) ([]uint64, *Inode, error) {
+	var got []uint64
+	next, err := t.RangeWithLimit(start, end, limit, func(v []byte) (bool, error) {
+		ino := &Inode{}
+		if err := ino.Unmarshal(v); err != nil {
+			return false, err
+		}
+		got = append(got, ino.Inode)
+		return true, nil
+	})
+	return got, next, err
+}
+
+// TestRangeWithLimitRespectsLimit checks RangeWithLimit stops after exactly
+// limit items even though more remain in [start, end), and that next points
+// at the first item the scan didn't visit.
+func TestRangeWithLimitRespectsLimit(t *testing.T) {
+	tree := newRangeTestTree(1, 2, 3, 4, 5)
+
+	got, next, err := collectInodesWithLimit(tree, &Inode{Inode: 1}, nil, 2)
+	if err != nil {
+		t.Fatalf("RangeWithLimit: %v", err)
+	}
+	want := []uint64{1, 2}
+	if len(got) != len(want) {
+		t.Fatalf("RangeWithLimit(1, nil, 2) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("RangeWithLimit(1, nil, 2) = %v, want %v", got, want)
+		}
+	}
+	if next == nil || next.Inode != 3 {
+		t.Fatalf("next = %v, want inode 3", next)
+	}
+}
+
+// TestRangeWithLimitNextNilAtTreeExhaustion checks next comes back nil when
+// the tree runs out of items before limit is reached.
+func TestRangeWithLimitNextNilAtTreeExhaustion(t *testing.T) {
+	tree := newRangeTestTree(1, 2, 3)
+
+	got, next, err := collectInodesWithLimit(tree, &Inode{Inode: 1}, nil, 10)
+	if err != nil {
+		t.Fatalf("RangeWithLimit: %v", err)
+	}
+	want := []uint64{1, 2, 3}
+	if len(got) != len(want) {
+		t.Fatalf("RangeWithLimit(1, nil, 10) = %v, want %v", got, want)
+	}
+	if next != nil {
+		t.Fatalf("next = %v, want nil at tree exhaustion", next)
+	}
+}
+
+// TestRangeWithLimitNextNilAtEnd checks next comes back nil when the scan
+// reaches end before limit is reached, same as tree exhaustion.
+func TestRangeWithLimitNextNilAtEnd(t *testing.T) {
+	tree := newRangeTestTree(1, 2, 3, 4, 5)
+
+	got, next, err := collectInodesWithLimit(tree, &Inode{Inode: 2}, &Inode{Inode: 4}, 10)
+	if err != nil {
+		t.Fatalf("RangeWithLimit: %v", err)
+	}
+	want := []uint64{2, 3}
+	if len(got) != len(want) {
+		t.Fatalf("RangeWithLimit(2, 4, 10) = %v, want %v", got, want)
+	}
+	if next != nil {
+		t.Fatalf("next = %v, want nil when the scan reaches end", next)
+	}
+}
+
+// TestRangeWithLimitResumeFromNextCoversRemainder checks paging through a
+// range by feeding each call's next back in as the following call's start
+// visits every item in [start, end) exactly once, with no gaps or
+// duplicates.
+func TestRangeWithLimitResumeFromNextCoversRemainder(t *testing.T) {
+	tree := newRangeTestTree(1, 2, 3, 4, 5, 6, 7)
+
+	var got []uint64
+	start := &Inode{Inode: 1}
+	for {
+		page, next, err := collectInodesWithLimit(tree, start, nil, 3)
+		if err != nil {
+			t.Fatalf("RangeWithLimit: %v", err)
+		}
+		got = append(got, page...)
+		if next == nil {
+			break
+		}
+		start = next
+	}
+
+	want := []uint64{1, 2, 3, 4, 5, 6, 7}
+	if len(got) != len(want) {
+		t.Fatalf("paged scan = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("paged scan = %v, want %v", got, want)
+		}
+	}
+}
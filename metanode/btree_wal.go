@@ -0,0 +1,496 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// walOp identifies the mutation recorded in a single WAL entry.
+type walOp byte
+
+const (
+	walOpPut walOp = iota
+	walOpDelete
+)
+
+const (
+	walFileName = "META.WAL"
+	ckptPrefix  = "META.CKPT."
+
+	// checkpointThreshold is the number of WAL bytes written since the last
+	// checkpoint that triggers an automatic checkpoint on the next Flush.
+	checkpointThreshold = 64 * 1024 * 1024
+)
+
+// walApplier rebuilds one in-memory item from its marshaled form and applies
+// it to the tree. Only the *BTree wrapper (InodeBTree, DentryBTree, ...) that
+// owns the item type knows how to unmarshal it, so replay/checkpoint defer
+// to a callback instead of the generic BTree doing it itself.
+type walApplier func(op walOp, data []byte) error
+
+// walDumper walks every live item of a tree snapshot, handing each one to cb
+// as if it had just been Put. It is how a checkpoint is produced from the
+// clone BTree.snapshotWithApplyID takes.
+type walDumper func(cb func(data []byte) error) error
+
+// wal is the append-only log plus checkpoint files backing one persistent
+// BTree. The layout mirrors the log-plus-snapshot pattern used by embedded
+// KV stores such as buntdb: a growing append-only file of Put/Delete
+// records keyed by raft ApplyID, periodically folded into a full checkpoint
+// so the log itself can be truncated.
+type wal struct {
+	mu      sync.Mutex
+	dir     string
+	tree    TreeType
+	file    *os.File
+	w       *bufio.Writer
+	written int64 // bytes appended since the last checkpoint
+
+	checkpointFn func() error
+}
+
+func walPath(dir string, tp TreeType) string {
+	return path.Join(dir, fmt.Sprintf("%s.%d", walFileName, tp))
+}
+
+func ckptPath(dir string, tp TreeType, applyID uint64) string {
+	return path.Join(dir, fmt.Sprintf("%s%d.%d", ckptPrefix, tp, applyID))
+}
+
+// openWAL opens (creating if necessary) the WAL file for the given tree in
+// dir and positions the writer at the end of the file for appending.
+func openWAL(dir string, tp TreeType) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(walPath(dir, tp), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{
+		dir:     dir,
+		tree:    tp,
+		file:    f,
+		w:       bufio.NewWriter(f),
+		written: info.Size(),
+	}, nil
+}
+
+// append writes one WAL record into the buffered writer and returns; the
+// record reaches the file only when the buffer fills or on Flush/sync, and
+// durability to disk only happens on Flush/sync.
+func (l *wal) append(applyID uint64, op walOp, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hdr := make([]byte, 8+1+4)
+	binary.BigEndian.PutUint64(hdr[0:8], applyID)
+	hdr[8] = byte(op)
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(data)))
+	if _, err := l.w.Write(hdr); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := l.w.Write(data); err != nil {
+			return err
+		}
+	}
+	l.written += int64(len(hdr) + len(data))
+	return nil
+}
+
+// sync flushes the buffered writer and fsyncs the underlying file.
+func (l *wal) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// shouldCheckpoint reports whether enough has been written since the last
+// checkpoint to make folding the log into a new snapshot worthwhile.
+func (l *wal) shouldCheckpoint() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written >= checkpointThreshold
+}
+
+// checkpoint writes a new checkpoint file at applyID from dump, then
+// compacts the WAL down to only the entries it cannot prove are covered by
+// this checkpoint (ApplyID > applyID). Blindly truncating the whole file
+// here would be wrong: if applyID ever under-reports what dump actually
+// captured (see BTree.snapshotWithApplyID), an entry that is not yet
+// reflected in the checkpoint would be discarded with nothing left to
+// replay it from, silently losing an already-durable, already-acknowledged
+// mutation across a crash.
+func (l *wal) checkpoint(applyID uint64, dump walDumper) error {
+	tmp := ckptPath(l.dir, l.tree, applyID) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = dump(func(data []byte) error {
+		var szbuf [4]byte
+		binary.BigEndian.PutUint32(szbuf[:], uint32(len(data)))
+		if _, err := w.Write(szbuf[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, ckptPath(l.dir, l.tree, applyID)); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err = l.w.Flush(); err != nil {
+		return err
+	}
+	if err = l.compactLocked(applyID); err != nil {
+		return err
+	}
+	removeStaleCheckpoints(l.dir, l.tree, applyID)
+	return nil
+}
+
+// compactLocked rewrites the WAL file keeping only the records with
+// ApplyID > applyID, then swaps it in for the live file. Callers must
+// already hold l.mu and must have flushed the writer beforehand.
+func (l *wal) compactLocked(applyID uint64) error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	p := walPath(l.dir, l.tree)
+	tmp := p + ".compact"
+	src, err := os.OpenFile(p, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	kept, err := copyWALAfter(dst, src, applyID)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, p); err != nil {
+		return err
+	}
+
+	f2, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = f2
+	l.w = bufio.NewWriter(f2)
+	l.written = kept
+	return nil
+}
+
+// copyWALAfter copies every WAL record in src with ApplyID > after to dst,
+// returning the number of bytes written. A short/corrupt trailing record
+// (a crash mid-append) stops the copy there, same as replayWAL.
+func copyWALAfter(dst io.Writer, src io.Reader, after uint64) (int64, error) {
+	r := bufio.NewReader(src)
+	var kept int64
+	for {
+		hdr := make([]byte, 8+1+4)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			break
+		}
+		applyID := binary.BigEndian.Uint64(hdr[0:8])
+		size := binary.BigEndian.Uint32(hdr[9:13])
+		data := make([]byte, size)
+		if size > 0 {
+			if _, err := io.ReadFull(r, data); err != nil {
+				break
+			}
+		}
+		if applyID <= after {
+			continue
+		}
+		if _, err := dst.Write(hdr); err != nil {
+			return kept, err
+		}
+		if len(data) > 0 {
+			if _, err := dst.Write(data); err != nil {
+				return kept, err
+			}
+		}
+		kept += int64(len(hdr) + len(data))
+	}
+	return kept, nil
+}
+
+// newRawWAL wraps an already-open file in a wal for use with
+// appendRaw/readRawRecords instead of the per-tree (applyID, op, data)
+// format append/replayWAL use. It is how Store's combined transaction log
+// reuses wal's buffering/fsync machinery without adopting a TreeType.
+func newRawWAL(dir string, f *os.File, size int64) *wal {
+	return &wal{
+		dir:     dir,
+		file:    f,
+		w:       bufio.NewWriter(f),
+		written: size,
+	}
+}
+
+// appendRaw writes one length-prefixed record, independent of the per-tree
+// WAL entry format.
+func (l *wal) appendRaw(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var szbuf [4]byte
+	binary.BigEndian.PutUint32(szbuf[:], uint32(len(data)))
+	if _, err := l.w.Write(szbuf[:]); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := l.w.Write(data); err != nil {
+			return err
+		}
+	}
+	l.written += int64(len(szbuf) + len(data))
+	return nil
+}
+
+// appendRawSynced appends data as one raw record and fsyncs it before
+// returning, for a caller (Txn.Commit) that must not tell the caller a
+// commit failed while the bytes it just wrote are still sitting in the log
+// file for a later replay to find anyway. If the fsync fails, the
+// just-appended bytes are truncated back out so the file never ends up
+// disagreeing with the failure this call reports.
+func (l *wal) appendRawSynced(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	preLen := l.written
+	var szbuf [4]byte
+	binary.BigEndian.PutUint32(szbuf[:], uint32(len(data)))
+	if _, err := l.w.Write(szbuf[:]); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := l.w.Write(data); err != nil {
+			return err
+		}
+	}
+	l.written += int64(len(szbuf) + len(data))
+
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		if terr := l.file.Truncate(preLen); terr == nil {
+			l.file.Seek(preLen, io.SeekStart)
+			l.w = bufio.NewWriter(l.file)
+			l.written = preLen
+		}
+		return err
+	}
+	return nil
+}
+
+// readRawRecords reads every record appendRaw wrote to path, in order,
+// handing each to cb. A short/corrupt trailing record (a crash mid-append)
+// stops the read there, same as replayWAL.
+func readRawRecords(path string, cb func(data []byte) error) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		var szbuf [4]byte
+		if _, err := io.ReadFull(r, szbuf[:]); err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(szbuf[:])
+		data := make([]byte, size)
+		if size > 0 {
+			if _, err := io.ReadFull(r, data); err != nil {
+				break
+			}
+		}
+		if err := cb(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestCheckpoint returns the ApplyID of the newest checkpoint file for tp
+// in dir, or (0, false) if none exists.
+func latestCheckpoint(dir string, tp TreeType) (uint64, bool) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, false
+	}
+	prefix := fmt.Sprintf("%s%d.", ckptPrefix, tp)
+	var best uint64
+	found := false
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		id, err := strconv.ParseUint(name[len(prefix):], 10, 64)
+		if err != nil {
+			continue
+		}
+		if !found || id > best {
+			best = id
+			found = true
+		}
+	}
+	return best, found
+}
+
+func removeStaleCheckpoints(dir string, tp TreeType, keep uint64) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	prefix := fmt.Sprintf("%s%d.", ckptPrefix, tp)
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		id, err := strconv.ParseUint(name[len(prefix):], 10, 64)
+		if err != nil || id == keep {
+			continue
+		}
+		os.Remove(path.Join(dir, name))
+	}
+}
+
+// replayCheckpoint feeds every record of the newest checkpoint file for tp
+// (if any) through apply, returning the ApplyID it was taken at.
+func replayCheckpoint(dir string, tp TreeType, apply walApplier) (uint64, error) {
+	applyID, ok := latestCheckpoint(dir, tp)
+	if !ok {
+		return 0, nil
+	}
+	f, err := os.Open(ckptPath(dir, tp, applyID))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		var szbuf [4]byte
+		if _, err := io.ReadFull(r, szbuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(szbuf[:])
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 0, err
+		}
+		if err := apply(walOpPut, data); err != nil {
+			return 0, err
+		}
+	}
+	return applyID, nil
+}
+
+// replayWAL feeds every WAL record for tp with ApplyID > after through apply,
+// in the order they were written, making replay exactly-once when resumed
+// from a checkpoint taken at ApplyID == after. It returns the highest
+// ApplyID it replayed (or after, if nothing newer was found), so a caller
+// like LoadWAL can leave the tree's own ApplyID reflecting the WAL entries
+// it just replayed instead of just the checkpoint it resumed from.
+func replayWAL(dir string, tp TreeType, after uint64, apply walApplier) (uint64, error) {
+	f, err := os.OpenFile(walPath(dir, tp), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return after, err
+	}
+	defer f.Close()
+	latest := after
+	r := bufio.NewReader(f)
+	for {
+		hdr := make([]byte, 8+1+4)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				break
+			}
+			// A short/corrupt trailing record means the process crashed
+			// mid-append; stop replay here rather than failing startup.
+			break
+		}
+		applyID := binary.BigEndian.Uint64(hdr[0:8])
+		op := walOp(hdr[8])
+		size := binary.BigEndian.Uint32(hdr[9:13])
+		data := make([]byte, size)
+		if size > 0 {
+			if _, err := io.ReadFull(r, data); err != nil {
+				break
+			}
+		}
+		if applyID <= after {
+			continue
+		}
+		if err := apply(op, data); err != nil {
+			return latest, err
+		}
+		if applyID > latest {
+			latest = applyID
+		}
+	}
+	return latest, nil
+}
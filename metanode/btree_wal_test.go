@@ -0,0 +1,154 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import "testing"
+
+// TestCheckpointCompactsOnlyCoveredEntries checks Checkpoint folds the WAL
+// entries up to its ApplyID into the checkpoint file and discards only
+// those, leaving anything appended after snapshotWithApplyID's clone was
+// taken (and so not reflected in the checkpoint) on the WAL for replay.
+func TestCheckpointCompactsOnlyCoveredEntries(t *testing.T) {
+	dir := t.TempDir()
+	tree := &InodeBTree{BTree: NewBtree()}
+	if err := tree.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL: %v", err)
+	}
+
+	for ino := uint64(1); ino <= 3; ino++ {
+		tree.BTree.SetApplyID(ino)
+		if err := tree.Put(&Inode{Inode: ino}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	// A record stamped with an ApplyID newer than the checkpoint's, whose
+	// mutation is not in the tree the checkpoint dumps, must be kept by
+	// compaction rather than discarded along with the covered ones.
+	late, err := (&Inode{Inode: 5}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := tree.BTree.wal.append(5, walOpPut, late); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := tree.BTree.wal.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if err := tree.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+
+	// An entry appended after the checkpoint must be replayed on top of it.
+	tree.BTree.SetApplyID(4)
+	if err := tree.Put(&Inode{Inode: 4}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := tree.BTree.wal.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	replayed := &InodeBTree{BTree: NewBtree()}
+	if err := replayed.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL after checkpoint: %v", err)
+	}
+	for ino := uint64(1); ino <= 5; ino++ {
+		if !replayed.BTree.Has(&Inode{Inode: ino}) {
+			t.Fatalf("inode %d missing after replaying checkpoint + remaining WAL", ino)
+		}
+	}
+}
+
+// TestLoadWALRebuildsSecondaryIndexes checks that replaying a checkpoint
+// plus trailing WAL entries into an index-bearing tree (NewInodeBTree's
+// mtime/size/uid indexes) rebuilds those indexes along with the primary
+// tree, instead of coming back empty because replay bypassed
+// ReplaceOrInsert/Delete.
+func TestLoadWALRebuildsSecondaryIndexes(t *testing.T) {
+	dir := t.TempDir()
+	tree := NewInodeBTree()
+	if err := tree.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL: %v", err)
+	}
+
+	tree.BTree.SetApplyID(1)
+	if err := tree.Put(&Inode{Inode: 1, Uid: 10}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := tree.BTree.wal.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if err := tree.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+
+	// This one is only in the WAL, not the checkpoint, so it exercises the
+	// replayWAL path's index rebuild as well as replayCheckpoint's.
+	tree.BTree.SetApplyID(2)
+	if err := tree.Put(&Inode{Inode: 2, Uid: 20}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := tree.BTree.wal.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	replayed := NewInodeBTree()
+	if err := replayed.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL after checkpoint: %v", err)
+	}
+
+	var gotUids []uint32
+	replayed.BTree.AscendIndex(IndexUid, &Inode{}, func(item BtreeItem) bool {
+		gotUids = append(gotUids, item.(*Inode).Uid)
+		return true
+	})
+	if len(gotUids) != 2 || gotUids[0] != 10 || gotUids[1] != 20 {
+		t.Fatalf("AscendIndex(IndexUid) after replay = %v, want [10 20]", gotUids)
+	}
+}
+
+// TestCheckpointSnapshotsTreeAndApplyIDTogether checks the ApplyID a
+// checkpoint is stamped with matches the data it dumped: a checkpoint taken
+// at ApplyID 1 is named for ApplyID 1 and replays inode 1. It runs
+// single-threaded, so no mutation races the clone.
+func TestCheckpointSnapshotsTreeAndApplyIDTogether(t *testing.T) {
+	dir := t.TempDir()
+	tree := &InodeBTree{BTree: NewBtree()}
+	if err := tree.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL: %v", err)
+	}
+
+	tree.BTree.SetApplyID(1)
+	if err := tree.Put(&Inode{Inode: 1}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := tree.BTree.wal.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if err := tree.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+
+	if applyID, ok := latestCheckpoint(dir, InodeType); !ok || applyID != 1 {
+		t.Fatalf("latestCheckpoint = (%d, %v), want (1, true)", applyID, ok)
+	}
+
+	replayed := &InodeBTree{BTree: NewBtree()}
+	if err := replayed.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL after checkpoint: %v", err)
+	}
+	if !replayed.BTree.Has(&Inode{Inode: 1}) {
+		t.Fatalf("inode 1 missing after replaying its own checkpoint")
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"github.com/chubaofs/chubaofs/util/btree"
+	"sync"
+)
+
+// IndexKey orders the entries of a secondary Index. Two keys built from the
+// same primary item must always compare equal, and the ordering must be
+// total (no two distinct primary items may produce equal keys) so the
+// secondary btree never silently merges two different items.
+type IndexKey interface {
+	Less(than IndexKey) bool
+}
+
+// indexEntry is what actually lives in an Index's btree: the secondary key
+// plus the primary item it was derived from, so a scan over the index can
+// hand the caller back the real item instead of just its key.
+type indexEntry struct {
+	key  IndexKey
+	item BtreeItem
+}
+
+func (e *indexEntry) Less(than btree.Item) bool {
+	return e.key.Less(than.(*indexEntry).key)
+}
+
+// Index is a secondary ordering over the items of a primary BTree. It keeps
+// its own btree of indexEntry, ordered by keyOf(item) instead of the
+// primary item's own Less, and is updated under the same lock as the
+// primary tree on every Put/Create/Delete so the two never drift apart.
+// This mirrors a pluggable-index-beside-a-primary-collection pattern: each
+// Index only needs a key extractor, not a whole copy of the stored data.
+type Index struct {
+	sync.RWMutex
+	name  string
+	tree  *btree.BTree
+	keyOf func(item BtreeItem) IndexKey
+}
+
+// NewIndex creates a named secondary index. keyOf must derive the same
+// IndexKey from an item every time it is called on that item's current
+// state, since Put re-derives the key to relocate the entry when an
+// indexed field changes.
+func NewIndex(name string, keyOf func(item BtreeItem) IndexKey) *Index {
+	return &Index{
+		name:  name,
+		tree:  btree.New(defaultBTreeDegree),
+		keyOf: keyOf,
+	}
+}
+
+// Name returns the index's registered name, as passed to AscendIndex /
+// DescendIndex.
+func (x *Index) Name() string {
+	return x.name
+}
+
+// Clone returns a point-in-time copy of the index, sharing btree nodes with
+// the original until either is next mutated, same as btree.BTree.Clone.
+func (x *Index) Clone() *Index {
+	x.RLock()
+	t := x.tree.Clone()
+	x.RUnlock()
+	return &Index{name: x.name, tree: t, keyOf: x.keyOf}
+}
+
+func (x *Index) put(item BtreeItem) {
+	x.Lock()
+	x.tree.ReplaceOrInsert(&indexEntry{key: x.keyOf(item), item: item})
+	x.Unlock()
+}
+
+func (x *Index) delete(item BtreeItem) {
+	x.Lock()
+	x.tree.Delete(&indexEntry{key: x.keyOf(item)})
+	x.Unlock()
+}
+
+// Ascend walks the index in ascending key order starting at pivot (itself a
+// primary item populated only with the fields keyOf needs), dereferencing
+// each entry back to its primary item.
+func (x *Index) Ascend(pivot BtreeItem, cb func(item BtreeItem) bool) {
+	x.RLock()
+	defer x.RUnlock()
+	x.tree.AscendGreaterOrEqual(&indexEntry{key: x.keyOf(pivot)}, func(bi btree.Item) bool {
+		return cb(bi.(*indexEntry).item)
+	})
+}
+
+// Descend walks the index in descending key order starting at pivot.
+func (x *Index) Descend(pivot BtreeItem, cb func(item BtreeItem) bool) {
+	x.RLock()
+	defer x.RUnlock()
+	x.tree.DescendLessOrEqual(&indexEntry{key: x.keyOf(pivot)}, func(bi btree.Item) bool {
+		return cb(bi.(*indexEntry).item)
+	})
+}
+
+// RegisterIndex adds idx to the set of secondary indexes kept in sync with
+// this tree's Put/Create/Delete.
+func (b *BTree) RegisterIndex(idx *Index) {
+	b.Lock()
+	if b.indexes == nil {
+		b.indexes = make(map[string]*Index)
+	}
+	b.indexes[idx.name] = idx
+	b.Unlock()
+}
+
+// AscendIndex walks the named secondary index in ascending order. It panics
+// if name was never registered via RegisterIndex, the same way Range panics
+// on an unknown TreeType.
+func (b *BTree) AscendIndex(name string, pivot BtreeItem, cb func(item BtreeItem) bool) {
+	b.RLock()
+	idx, ok := b.indexes[name]
+	b.RUnlock()
+	if !ok {
+		panic("unknown index: " + name)
+	}
+	idx.Ascend(pivot, cb)
+}
+
+// DescendIndex walks the named secondary index in descending order.
+func (b *BTree) DescendIndex(name string, pivot BtreeItem, cb func(item BtreeItem) bool) {
+	b.RLock()
+	idx, ok := b.indexes[name]
+	b.RUnlock()
+	if !ok {
+		panic("unknown index: " + name)
+	}
+	idx.Descend(pivot, cb)
+}
+
+// updateIndexesLocked relocates item in every registered index. Callers
+// must already hold b's write lock.
+func (b *BTree) updateIndexesLocked(item BtreeItem) {
+	for _, idx := range b.indexes {
+		idx.put(item)
+	}
+}
+
+// removeFromIndexesLocked drops item from every registered index. Callers
+// must already hold b's write lock.
+func (b *BTree) removeFromIndexesLocked(item BtreeItem) {
+	for _, idx := range b.indexes {
+		idx.delete(item)
+	}
+}
+
+// mtimeKey orders inodes by (ModifyTime, Inode) so entries with an equal
+// mtime still sort deterministically.
+type mtimeKey struct {
+	mtime uint64
+	ino   uint64
+}
+
+func (k mtimeKey) Less(than IndexKey) bool {
+	o := than.(mtimeKey)
+	if k.mtime != o.mtime {
+		return k.mtime < o.mtime
+	}
+	return k.ino < o.ino
+}
+
+// sizeKey orders inodes by (Size, Inode).
+type sizeKey struct {
+	size uint64
+	ino  uint64
+}
+
+func (k sizeKey) Less(than IndexKey) bool {
+	o := than.(sizeKey)
+	if k.size != o.size {
+		return k.size < o.size
+	}
+	return k.ino < o.ino
+}
+
+// uidKey orders inodes by (Uid, Inode).
+type uidKey struct {
+	uid uint32
+	ino uint64
+}
+
+func (k uidKey) Less(than IndexKey) bool {
+	o := than.(uidKey)
+	if k.uid != o.uid {
+		return k.uid < o.uid
+	}
+	return k.ino < o.ino
+}
+
+// parentKey orders dentries by (ParentId, Name), letting a scan pivot on
+// ParentId alone to enumerate a directory without knowing any child names.
+type parentKey struct {
+	parentID uint64
+	name     string
+}
+
+func (k parentKey) Less(than IndexKey) bool {
+	o := than.(parentKey)
+	if k.parentID != o.parentID {
+		return k.parentID < o.parentID
+	}
+	return k.name < o.name
+}
+
+const (
+	// IndexMtime, IndexSize and IndexUid name InodeBTree's secondary
+	// indexes; IndexParent names DentryBTree's.
+	IndexMtime  = "mtime"
+	IndexSize   = "size"
+	IndexUid    = "uid"
+	IndexParent = "parent"
+)
+
+// NewInodeBTree creates an InodeBTree with its mtime/size/uid secondary
+// indexes registered, ready to be used by callers that need AscendIndex /
+// DescendIndex lookups such as TTL scans and quota reports.
+func NewInodeBTree() *InodeBTree {
+	i := &InodeBTree{BTree: NewBtree()}
+	i.BTree.RegisterIndex(NewIndex(IndexMtime, func(item BtreeItem) IndexKey {
+		ino := item.(*Inode)
+		return mtimeKey{mtime: ino.ModifyTime, ino: ino.Inode}
+	}))
+	i.BTree.RegisterIndex(NewIndex(IndexSize, func(item BtreeItem) IndexKey {
+		ino := item.(*Inode)
+		return sizeKey{size: ino.Size, ino: ino.Inode}
+	}))
+	i.BTree.RegisterIndex(NewIndex(IndexUid, func(item BtreeItem) IndexKey {
+		ino := item.(*Inode)
+		return uidKey{uid: ino.Uid, ino: ino.Inode}
+	}))
+	return i
+}
+
+// NewDentryBTree creates a DentryBTree with its parent secondary index
+// registered, letting callers enumerate a directory's children by
+// ParentId alone via AscendIndex(IndexParent, ...).
+func NewDentryBTree() *DentryBTree {
+	d := &DentryBTree{BTree: NewBtree()}
+	d.BTree.RegisterIndex(NewIndex(IndexParent, func(item BtreeItem) IndexKey {
+		den := item.(*Dentry)
+		return parentKey{parentID: den.ParentId, name: den.Name}
+	}))
+	return d
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import "testing"
+
+// TestChangesSinceTracksMutations checks changesSince reports exactly the
+// keys mutated between two generations once EnableChangeLog is on.
+func TestChangesSinceTracksMutations(t *testing.T) {
+	b := NewBtree()
+	b.EnableChangeLog()
+
+	b.ReplaceOrInsert(&Inode{Inode: 1}, true)
+	gen1 := b.Generation()
+	b.ReplaceOrInsert(&Inode{Inode: 2}, true)
+	b.Delete(&Inode{Inode: 1})
+	gen2 := b.Generation()
+
+	keys, ok := b.changesSince(gen1, gen2)
+	if !ok {
+		t.Fatalf("changesSince reported ok=false with the log well within capacity")
+	}
+	if len(keys) != 2 {
+		t.Fatalf("changesSince(%d, %d) = %v, want 2 keys", gen1, gen2, keys)
+	}
+}
+
+// TestChangesSinceFallsBackWithoutEnableChangeLog checks a tree that never
+// called EnableChangeLog always reports ok=false, so callers fall back to a
+// full scan instead of trusting an empty, untracked log.
+func TestChangesSinceFallsBackWithoutEnableChangeLog(t *testing.T) {
+	b := NewBtree()
+	b.ReplaceOrInsert(&Inode{Inode: 1}, true)
+	if _, ok := b.changesSince(0, b.Generation()); ok {
+		t.Fatalf("changesSince reported ok=true without EnableChangeLog ever being called")
+	}
+}
+
+// TestChangesSinceFallsBackWhenLogOverflows checks changesSince reports
+// ok=false once more than changeLogCapacity mutations have aged the
+// requested generation's entries out of the log, rather than silently
+// returning an incomplete key set.
+func TestChangesSinceFallsBackWhenLogOverflows(t *testing.T) {
+	b := NewBtree()
+	b.EnableChangeLog()
+
+	b.ReplaceOrInsert(&Inode{Inode: 0}, true)
+	gen1 := b.Generation()
+	for i := uint64(1); i <= changeLogCapacity+1; i++ {
+		b.ReplaceOrInsert(&Inode{Inode: i}, true)
+	}
+	gen2 := b.Generation()
+
+	if _, ok := b.changesSince(gen1, gen2); ok {
+		t.Fatalf("changesSince reported ok=true after the log overflowed past gen1")
+	}
+}
+
+// TestSnapshotDiffIncremental checks SnapshotDiff reports the right
+// Added/Changed/Removed entries when the underlying Store has
+// EnableChangeLog on, exercising the changesSince-backed incremental path.
+func TestSnapshotDiffIncremental(t *testing.T) {
+	s := NewStore()
+	s.EnableChangeLog()
+	s.Inode.BTree.ReplaceOrInsert(&Inode{Inode: 1}, true)
+	s.Inode.BTree.ReplaceOrInsert(&Inode{Inode: 2}, true)
+
+	m := NewSnapshotManager()
+	oldID := m.Acquire(s, 1)
+	defer m.Release(oldID)
+
+	s.Inode.BTree.ReplaceOrInsert(&Inode{Inode: 2, Uid: 7}, true) // changed
+	s.Inode.BTree.Delete(&Inode{Inode: 1})                        // removed
+	s.Inode.BTree.ReplaceOrInsert(&Inode{Inode: 3}, true)         // added
+
+	newID := m.Acquire(s, 2)
+	defer m.Release(newID)
+
+	var added, changed, removed int
+	if err := m.SnapshotDiff(oldID, newID, func(e DiffEntry) (bool, error) {
+		switch e.Kind {
+		case DiffAdded:
+			added++
+		case DiffChanged:
+			changed++
+		case DiffRemoved:
+			removed++
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("SnapshotDiff: %v", err)
+	}
+
+	if added != 1 || changed != 1 || removed != 1 {
+		t.Fatalf("SnapshotDiff = added=%d changed=%d removed=%d, want 1/1/1", added, changed, removed)
+	}
+}
+
+// TestSnapshotDiffFallsBackWithoutChangeLog checks SnapshotDiff still
+// reports the correct diff via the full-scan fallback when the Store never
+// called EnableChangeLog.
+func TestSnapshotDiffFallsBackWithoutChangeLog(t *testing.T) {
+	s := NewStore()
+	s.Inode.BTree.ReplaceOrInsert(&Inode{Inode: 1}, true)
+
+	m := NewSnapshotManager()
+	oldID := m.Acquire(s, 1)
+	defer m.Release(oldID)
+
+	s.Inode.BTree.ReplaceOrInsert(&Inode{Inode: 2}, true)
+
+	newID := m.Acquire(s, 2)
+	defer m.Release(newID)
+
+	var added int
+	if err := m.SnapshotDiff(oldID, newID, func(e DiffEntry) (bool, error) {
+		if e.Kind == DiffAdded {
+			added++
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("SnapshotDiff: %v", err)
+	}
+	if added != 1 {
+		t.Fatalf("SnapshotDiff fallback found %d added entries, want 1", added)
+	}
+}
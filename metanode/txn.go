@@ -0,0 +1,601 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+var (
+	// txnClosedError is returned by any Txn method called after Commit or
+	// Rollback has already run.
+	txnClosedError = errors.New("txn already committed or rolled back")
+	// txnReadOnlyError is returned by a write method called on a Txn opened
+	// with Begin(true).
+	txnReadOnlyError = errors.New("cannot write inside a read-only txn")
+)
+
+// Store bundles the four BTree-backed trees a metadata partition keeps, so
+// mkdir/rename and similar operations that must touch more than one of them
+// can do so inside a single atomic Txn instead of relying on the raft apply
+// loop alone for consistency.
+type Store struct {
+	Inode     *InodeBTree
+	Dentry    *DentryBTree
+	Extend    *ExtendBTree
+	Multipart *MultipartBTree
+
+	// txnWAL, once set by EnableTxnLog, is where Commit writes the single
+	// combined log record for a cross-tree transaction. nil means Commit
+	// falls back to each mutation's own tree's per-tree WAL.
+	txnWAL *wal
+}
+
+// NewStore creates a Store with the Inode and Dentry trees' secondary
+// indexes already registered.
+func NewStore() *Store {
+	return &Store{
+		Inode:     NewInodeBTree(),
+		Dentry:    NewDentryBTree(),
+		Extend:    &ExtendBTree{BTree: NewBtree()},
+		Multipart: &MultipartBTree{BTree: NewBtree()},
+	}
+}
+
+// EnableChangeLog turns on per-mutation generation tracking on all four
+// trees, so SnapshotManager.SnapshotDiff can answer "what changed between
+// two snapshots" by replaying recent mutations instead of scanning both
+// trees in full. Like EnableTxnLog, this is opt-in and costs nothing until
+// called; a Store that never calls it still gets correct diffs, just via
+// SnapshotDiff's full-scan fallback.
+func (s *Store) EnableChangeLog() {
+	s.Inode.BTree.EnableChangeLog()
+	s.Dentry.BTree.EnableChangeLog()
+	s.Extend.BTree.EnableChangeLog()
+	s.Multipart.BTree.EnableChangeLog()
+}
+
+// txnWalFileName names the Store's combined commit log, kept separate from
+// each BTree's own per-tree WAL file.
+const txnWalFileName = "META.TXN.WAL"
+
+// EnableTxnLog turns on the combined transaction log Commit writes to, so a
+// cross-tree Txn produces one fsynced record covering every staged mutation
+// instead of reusing each tree's own per-tree WAL, which would split one
+// commit across up to four separate files and fsync points - a crash
+// between two of those writes would leave exactly the cross-tree
+// inconsistency Txn exists to prevent. The log only grows; coordinating its
+// compaction against all four trees' independent checkpoints is left for a
+// follow-up. In the meantime each mutation is stamped with its target
+// tree's ApplyID at commit time, so even though the log itself is never
+// trimmed, ReplayTxnLog can tell which of its entries a tree has already
+// moved past and skip them instead of replaying stale values over newer
+// ones.
+func (s *Store) EnableTxnLog(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	w, err := openRawWAL(dir)
+	if err != nil {
+		return err
+	}
+	s.txnWAL = w
+	return nil
+}
+
+// openRawWAL opens (creating if necessary) the combined transaction log
+// file in dir, positioned for appending.
+func openRawWAL(dir string) (*wal, error) {
+	f, err := os.OpenFile(path.Join(dir, txnWalFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newRawWAL(dir, f, info.Size()), nil
+}
+
+// ReplayTxnLog redoes every record in the combined transaction log against
+// the live trees. It must run after each tree's own LoadWAL, since a Commit
+// made while EnableTxnLog was on never touches the per-tree WALs at all -
+// the combined log is the only durable record of those mutations. Unlike
+// the per-tree WAL, this log is never compacted, so it can carry mutations
+// a tree's own checkpoint/WAL already has a newer value for (e.g. a key
+// touched once via a Txn and later overwritten by an ordinary, non-Txn
+// Put on the same tree); replaying those unconditionally would regress the
+// tree back to the stale Txn-era value. Each mutation is applied only if
+// its applyID is newer than the target tree's current ApplyID, the same
+// "skip what's already covered" rule replayWAL uses against a checkpoint.
+// A mutation logged with applyID 0 (the Store it was committed under never
+// called SetApplyID) cannot be compared this way and is always replayed,
+// same as before this check existed.
+func (s *Store) ReplayTxnLog(dir string) error {
+	p := path.Join(dir, txnWalFileName)
+	if err := readRawRecords(p, func(data []byte) error {
+		muts, err := decodeTxnRecord(data)
+		if err != nil {
+			return err
+		}
+		for _, m := range muts {
+			if m.applyID != 0 && m.applyID <= treeApplyID(s, m.tree) {
+				continue
+			}
+			if err := applyTxnMutation(s, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	w, err := openRawWAL(dir)
+	if err != nil {
+		return err
+	}
+	s.txnWAL = w
+	return nil
+}
+
+// treeApplyID returns the current ApplyID of s's tree tp, so ReplayTxnLog
+// can tell whether a combined-log mutation against that tree is already
+// reflected in the tree's own state.
+func treeApplyID(s *Store, tp TreeType) uint64 {
+	switch tp {
+	case InodeType:
+		return s.Inode.BTree.ApplyID()
+	case DentryType:
+		return s.Dentry.BTree.ApplyID()
+	case ExtendType:
+		return s.Extend.BTree.ApplyID()
+	case MultipartType:
+		return s.Multipart.BTree.ApplyID()
+	default:
+		return 0
+	}
+}
+
+// applyTxnMutation applies one combined-log mutation to the live store,
+// the same way the matching Txn.Put*/Delete* method's apply step would,
+// except that it takes each tree's lock itself, since ReplayTxnLog holds
+// none.
+func applyTxnMutation(s *Store, m txnMutation) error {
+	switch m.tree {
+	case InodeType:
+		item := &Inode{}
+		if err := item.Unmarshal(m.data); err != nil {
+			return err
+		}
+		if m.op == walOpDelete {
+			s.Inode.BTree.Delete(item)
+		} else {
+			s.Inode.BTree.ReplaceOrInsert(item, true)
+		}
+	case DentryType:
+		item := &Dentry{}
+		if err := item.Unmarshal(m.data); err != nil {
+			return err
+		}
+		if m.op == walOpDelete {
+			s.Dentry.BTree.Delete(item)
+		} else {
+			s.Dentry.BTree.ReplaceOrInsert(item, true)
+		}
+	case ExtendType:
+		item, err := NewExtendFromBytes(m.data)
+		if err != nil {
+			return err
+		}
+		if m.op == walOpDelete {
+			s.Extend.BTree.Delete(item)
+		} else {
+			s.Extend.BTree.ReplaceOrInsert(item, true)
+		}
+	case MultipartType:
+		item := MultipartFromBytes(m.data)
+		if m.op == walOpDelete {
+			s.Multipart.BTree.Delete(item)
+		} else {
+			s.Multipart.BTree.ReplaceOrInsert(item, true)
+		}
+	default:
+		return fmt.Errorf("txn log: unknown tree type %d", m.tree)
+	}
+	return nil
+}
+
+// txnMutation is one staged write, recorded so Commit can serialize every
+// mutation of a transaction into a single combined log record before
+// applying any of them. applyID is stamped by Commit, not by the
+// PutInode/PutDentry/... staging call, since it must reflect the target
+// tree's ApplyID at commit time for ReplayTxnLog's "already covered" check
+// to mean anything.
+type txnMutation struct {
+	tree    TreeType
+	op      walOp
+	data    []byte
+	applyID uint64
+}
+
+// txnOp pairs a txnMutation - what Commit logs - with the pure in-memory
+// step that applies it to the live Store once all four tree locks are
+// held.
+type txnOp struct {
+	mut   txnMutation
+	apply func(s *Store) error
+}
+
+// encodeTxnRecord serializes every op's txnMutation into one combined log
+// record: a count, followed by each mutation as (tree byte, op byte, an
+// 8-byte big-endian applyID, a 4-byte big-endian length, data).
+func encodeTxnRecord(ops []txnOp) []byte {
+	size := 4
+	for _, op := range ops {
+		size += 1 + 1 + 8 + 4 + len(op.mut.data)
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(ops)))
+	off := 4
+	for _, op := range ops {
+		buf[off] = byte(op.mut.tree)
+		buf[off+1] = byte(op.mut.op)
+		binary.BigEndian.PutUint64(buf[off+2:off+10], op.mut.applyID)
+		binary.BigEndian.PutUint32(buf[off+10:off+14], uint32(len(op.mut.data)))
+		off += 14
+		off += copy(buf[off:], op.mut.data)
+	}
+	return buf
+}
+
+// decodeTxnRecord reverses encodeTxnRecord. A truncated record (a crash
+// mid-append) is reported as an error so ReplayTxnLog's caller, like
+// replayWAL, can stop there instead of misreading garbage as a mutation.
+func decodeTxnRecord(data []byte) ([]txnMutation, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("txn log: truncated record header")
+	}
+	count := binary.BigEndian.Uint32(data[0:4])
+	data = data[4:]
+	// Each mutation needs at least a 14-byte header, so a count this large
+	// cannot possibly be backed by the data that follows; reject it up
+	// front instead of pre-allocating a slice sized off a corrupt count
+	// (e.g. a crash mid-write leaving garbage in the count field).
+	const minMutationSize = 1 + 1 + 8 + 4
+	if uint64(count)*minMutationSize > uint64(len(data)) {
+		return nil, fmt.Errorf("txn log: record count %d inconsistent with remaining %d bytes", count, len(data))
+	}
+	muts := make([]txnMutation, 0, count)
+	for n := uint32(0); n < count; n++ {
+		if len(data) < minMutationSize {
+			return nil, fmt.Errorf("txn log: truncated mutation header")
+		}
+		tree := TreeType(data[0])
+		op := walOp(data[1])
+		applyID := binary.BigEndian.Uint64(data[2:10])
+		size := binary.BigEndian.Uint32(data[10:14])
+		data = data[14:]
+		if uint32(len(data)) < size {
+			return nil, fmt.Errorf("txn log: truncated mutation data")
+		}
+		muts = append(muts, txnMutation{tree: tree, op: op, applyID: applyID, data: data[:size:size]})
+		data = data[size:]
+	}
+	return muts, nil
+}
+
+// appendPerTreeWAL is Commit's fallback when the Store has no combined
+// transaction log configured: it writes m to the WAL of the one tree it
+// belongs to, same as the pre-Txn per-tree Put/Delete path did. Split
+// across up to four such calls, it is not itself atomic across a crash -
+// EnableTxnLog is what closes that gap.
+func appendPerTreeWAL(s *Store, m txnMutation) error {
+	var b *BTree
+	switch m.tree {
+	case InodeType:
+		b = s.Inode.BTree
+	case DentryType:
+		b = s.Dentry.BTree
+	case ExtendType:
+		b = s.Extend.BTree
+	case MultipartType:
+		b = s.Multipart.BTree
+	default:
+		return fmt.Errorf("txn log: unknown tree type %d", m.tree)
+	}
+	if b.wal == nil {
+		return nil
+	}
+	return b.wal.append(b.ApplyID(), m.op, m.data)
+}
+
+// Txn is a cross-tree transaction over a Store's four BTrees, modeled on
+// the db.Update/db.View pair buntdb exposes over its own btree: Begin(true)
+// opens a read-only view of a consistent snapshot, Begin(false) additionally
+// lets the caller stage Put/Delete calls that are applied to all four trees
+// atomically on Commit.
+type Txn struct {
+	store    *Store
+	readonly bool
+	done     bool
+
+	snapInode     *InodeBTree
+	snapDentry    *DentryBTree
+	snapExtend    *ExtendBTree
+	snapMultipart *MultipartBTree
+
+	ops []txnOp
+}
+
+// Begin opens a Txn. Reads made through Inode()/Dentry()/Extend()/
+// Multipart() always see the snapshot taken here via GetTree(), regardless
+// of readonly, so a write Txn can stage mutations based on a consistent
+// view instead of the live, concurrently-mutating trees.
+func (s *Store) Begin(readonly bool) (*Txn, error) {
+	return &Txn{
+		store:         s,
+		readonly:      readonly,
+		snapInode:     &InodeBTree{BTree: s.Inode.BTree.GetTree()},
+		snapDentry:    &DentryBTree{BTree: s.Dentry.BTree.GetTree()},
+		snapExtend:    &ExtendBTree{BTree: s.Extend.BTree.GetTree()},
+		snapMultipart: &MultipartBTree{BTree: s.Multipart.BTree.GetTree()},
+	}, nil
+}
+
+// Inode returns a read-only view of the Inode tree as of Begin.
+func (t *Txn) Inode() *InodeBTree { return t.snapInode }
+
+// Dentry returns a read-only view of the Dentry tree as of Begin.
+func (t *Txn) Dentry() *DentryBTree { return t.snapDentry }
+
+// Extend returns a read-only view of the Extend tree as of Begin.
+func (t *Txn) Extend() *ExtendBTree { return t.snapExtend }
+
+// Multipart returns a read-only view of the Multipart tree as of Begin.
+func (t *Txn) Multipart() *MultipartBTree { return t.snapMultipart }
+
+func (t *Txn) stage(op txnOp) error {
+	if t.done {
+		return txnClosedError
+	}
+	if t.readonly {
+		return txnReadOnlyError
+	}
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+// PutInode stages an upsert of inode into the Inode tree. inode is marshaled
+// immediately and that marshaled copy, not the caller's pointer, is what
+// Commit both logs and applies - so a caller that mutates inode after
+// staging can never make the applied tree state disagree with what was
+// logged.
+func (t *Txn) PutInode(inode *Inode) error {
+	data, err := inode.Marshal()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: InodeType, op: walOpPut, data: data},
+		apply: func(s *Store) error {
+			item := &Inode{}
+			if err := item.Unmarshal(data); err != nil {
+				return err
+			}
+			s.Inode.BTree.replaceOrInsertLocked(item, true)
+			return nil
+		},
+	})
+}
+
+// DeleteInode stages removal of ino from the Inode tree.
+func (t *Txn) DeleteInode(ino uint64) error {
+	key := &Inode{Inode: ino}
+	data, err := key.Marshal()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: InodeType, op: walOpDelete, data: data},
+		apply: func(s *Store) error {
+			s.Inode.BTree.deleteLocked(key)
+			return nil
+		},
+	})
+}
+
+// PutDentry stages an upsert of dentry into the Dentry tree. See PutInode
+// for why apply reconstructs the item from the marshaled data rather than
+// reusing the caller's pointer.
+func (t *Txn) PutDentry(dentry *Dentry) error {
+	data, err := dentry.Marshal()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: DentryType, op: walOpPut, data: data},
+		apply: func(s *Store) error {
+			item := &Dentry{}
+			if err := item.Unmarshal(data); err != nil {
+				return err
+			}
+			s.Dentry.BTree.replaceOrInsertLocked(item, true)
+			return nil
+		},
+	})
+}
+
+// DeleteDentry stages removal of the (pid, name) dentry from the Dentry tree.
+func (t *Txn) DeleteDentry(pid uint64, name string) error {
+	key := &Dentry{ParentId: pid, Name: name}
+	data, err := key.Marshal()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: DentryType, op: walOpDelete, data: data},
+		apply: func(s *Store) error {
+			s.Dentry.BTree.deleteLocked(key)
+			return nil
+		},
+	})
+}
+
+// PutExtend stages an upsert of extend into the Extend tree. See PutInode
+// for why apply reconstructs the item from the marshaled data rather than
+// reusing the caller's pointer.
+func (t *Txn) PutExtend(extend *Extend) error {
+	data, err := extend.Bytes()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: ExtendType, op: walOpPut, data: data},
+		apply: func(s *Store) error {
+			item, err := NewExtendFromBytes(data)
+			if err != nil {
+				return err
+			}
+			s.Extend.BTree.replaceOrInsertLocked(item, true)
+			return nil
+		},
+	})
+}
+
+// DeleteExtend stages removal of ino's extend attributes from the Extend tree.
+func (t *Txn) DeleteExtend(ino uint64) error {
+	key := &Extend{inode: ino}
+	data, err := key.Bytes()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: ExtendType, op: walOpDelete, data: data},
+		apply: func(s *Store) error {
+			s.Extend.BTree.deleteLocked(key)
+			return nil
+		},
+	})
+}
+
+// PutMultipart stages an upsert of mul into the Multipart tree. See
+// PutInode for why apply reconstructs the item from the marshaled data
+// rather than reusing the caller's pointer.
+func (t *Txn) PutMultipart(mul *Multipart) error {
+	data, err := mul.Bytes()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: MultipartType, op: walOpPut, data: data},
+		apply: func(s *Store) error {
+			item := MultipartFromBytes(data)
+			s.Multipart.BTree.replaceOrInsertLocked(item, true)
+			return nil
+		},
+	})
+}
+
+// DeleteMultipart stages removal of the (key, id) multipart session.
+func (t *Txn) DeleteMultipart(key, id string) error {
+	k := &Multipart{key: key, id: id}
+	data, err := k.Bytes()
+	if err != nil {
+		return err
+	}
+	return t.stage(txnOp{
+		mut: txnMutation{tree: MultipartType, op: walOpDelete, data: data},
+		apply: func(s *Store) error {
+			s.Multipart.BTree.deleteLocked(k)
+			return nil
+		},
+	})
+}
+
+// Commit applies every staged mutation to the live trees atomically: all
+// four BTree locks are taken in the fixed order Inode, Dentry, Extend,
+// Multipart (the same order every Commit uses, so two concurrent Commits
+// can never deadlock on each other), and only then - still under all four
+// locks - is the transaction logged and applied, in that order. Logging
+// before taking the locks would let two concurrent Commits' log records
+// land in one order while the locks hand them the opposite order to apply
+// in, so a crash could make ReplayTxnLog reconstruct a different winner on
+// overlapping keys than the one already live and acknowledged before the
+// crash. If the Store has a combined transaction log (EnableTxnLog), every
+// staged mutation is written as one record and fsynced; otherwise each op
+// falls back to appending to its own tree's per-tree WAL. A read-only
+// Txn's Commit is a no-op besides closing it, since nothing was staged.
+func (t *Txn) Commit() error {
+	if t.done {
+		return txnClosedError
+	}
+	t.done = true
+	if t.readonly || len(t.ops) == 0 {
+		return nil
+	}
+
+	s := t.store
+	s.Inode.BTree.Lock()
+	s.Dentry.BTree.Lock()
+	s.Extend.BTree.Lock()
+	s.Multipart.BTree.Lock()
+	defer func() {
+		s.Multipart.BTree.Unlock()
+		s.Extend.BTree.Unlock()
+		s.Dentry.BTree.Unlock()
+		s.Inode.BTree.Unlock()
+	}()
+
+	if s.txnWAL != nil {
+		// Stamp each mutation with its tree's current ApplyID before
+		// logging, under the same locks Commit already holds, so
+		// ReplayTxnLog can later tell whether a tree's own state has
+		// already moved past this mutation.
+		for i := range t.ops {
+			t.ops[i].mut.applyID = treeApplyID(s, t.ops[i].mut.tree)
+		}
+		if err := s.txnWAL.appendRawSynced(encodeTxnRecord(t.ops)); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range t.ops {
+		if err := op.apply(s); err != nil {
+			return err
+		}
+		if s.txnWAL == nil {
+			if err := appendPerTreeWAL(s, op.mut); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Rollback discards every staged mutation. Since nothing is applied to the
+// live trees until Commit, this is just bookkeeping.
+func (t *Txn) Rollback() error {
+	if t.done {
+		return txnClosedError
+	}
+	t.done = true
+	t.ops = nil
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2018 The Chubao Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package metanode
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestEncodeDecodeTxnRecord round-trips a multi-mutation commit record
+// through encodeTxnRecord/decodeTxnRecord, including each mutation's
+// applyID.
+func TestEncodeDecodeTxnRecord(t *testing.T) {
+	ops := []txnOp{
+		{mut: txnMutation{tree: InodeType, op: walOpPut, applyID: 1, data: []byte("inode-1")}},
+		{mut: txnMutation{tree: DentryType, op: walOpDelete, applyID: 2, data: []byte("dentry-1")}},
+		{mut: txnMutation{tree: ExtendType, op: walOpPut, applyID: 0, data: []byte{}}},
+	}
+
+	got, err := decodeTxnRecord(encodeTxnRecord(ops))
+	if err != nil {
+		t.Fatalf("decodeTxnRecord: %v", err)
+	}
+	want := make([]txnMutation, len(ops))
+	for i, op := range ops {
+		want[i] = op.mut
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decodeTxnRecord = %+v, want %+v", got, want)
+	}
+}
+
+// TestDecodeTxnRecordRejectsCorruptCount checks a record whose count field
+// can't possibly be backed by the data that follows (as a crash mid-write
+// could leave behind) is rejected instead of driving an oversized alloc.
+func TestDecodeTxnRecordRejectsCorruptCount(t *testing.T) {
+	data := make([]byte, 4)
+	// A count this large cannot be satisfied by zero remaining bytes.
+	data[0], data[1], data[2], data[3] = 0xff, 0xff, 0xff, 0xff
+	if _, err := decodeTxnRecord(data); err == nil {
+		t.Fatalf("decodeTxnRecord accepted a corrupt count instead of erroring")
+	}
+}
+
+// TestTxnCommitAppliesAllTreesAtomically stages a mutation against two
+// trees in one Txn and checks both land together on Commit.
+func TestTxnCommitAppliesAllTreesAtomically(t *testing.T) {
+	s := NewStore()
+
+	txn, err := s.Begin(false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := txn.PutInode(&Inode{Inode: 1}); err != nil {
+		t.Fatalf("PutInode: %v", err)
+	}
+	if err := txn.PutDentry(&Dentry{ParentId: 1, Name: "a"}); err != nil {
+		t.Fatalf("PutDentry: %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if !s.Inode.BTree.Has(&Inode{Inode: 1}) {
+		t.Fatalf("inode 1 missing after commit")
+	}
+	if !s.Dentry.BTree.Has(&Dentry{ParentId: 1, Name: "a"}) {
+		t.Fatalf("dentry (1, a) missing after commit")
+	}
+}
+
+// TestTxnCommitUsesValueAsOfStaging checks a caller mutating an object after
+// staging it can't change what Commit applies: the tree must end up with
+// the value as of the PutInode call, matching what was logged.
+func TestTxnCommitUsesValueAsOfStaging(t *testing.T) {
+	s := NewStore()
+
+	txn, err := s.Begin(false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	inode := &Inode{Inode: 1, Uid: 1}
+	if err := txn.PutInode(inode); err != nil {
+		t.Fatalf("PutInode: %v", err)
+	}
+	inode.Uid = 2 // mutated after staging, must not affect the committed value
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	got, err := s.Inode.Get(1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Uid != 1 {
+		t.Fatalf("committed inode has Uid %d, want 1 (the value as of PutInode)", got.Uid)
+	}
+}
+
+// TestTxnRollbackAppliesNothing checks staged mutations never reach the
+// live trees if Rollback is called instead of Commit.
+func TestTxnRollbackAppliesNothing(t *testing.T) {
+	s := NewStore()
+
+	txn, err := s.Begin(false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := txn.PutInode(&Inode{Inode: 1}); err != nil {
+		t.Fatalf("PutInode: %v", err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	if s.Inode.BTree.Has(&Inode{Inode: 1}) {
+		t.Fatalf("inode 1 present after rollback")
+	}
+}
+
+// TestTxnCommitWritesOneCombinedRecord checks a multi-tree Commit with
+// EnableTxnLog produces exactly one record in the combined log, covering
+// every staged mutation, rather than one record per tree.
+func TestTxnCommitWritesOneCombinedRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore()
+	if err := s.EnableTxnLog(dir); err != nil {
+		t.Fatalf("EnableTxnLog: %v", err)
+	}
+
+	txn, err := s.Begin(false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := txn.PutInode(&Inode{Inode: 1}); err != nil {
+		t.Fatalf("PutInode: %v", err)
+	}
+	if err := txn.PutDentry(&Dentry{ParentId: 1, Name: "a"}); err != nil {
+		t.Fatalf("PutDentry: %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	records := 0
+	var muts []txnMutation
+	p := filepath.Join(dir, txnWalFileName)
+	if err := readRawRecords(p, func(data []byte) error {
+		records++
+		decoded, err := decodeTxnRecord(data)
+		if err != nil {
+			return err
+		}
+		muts = append(muts, decoded...)
+		return nil
+	}); err != nil {
+		t.Fatalf("readRawRecords: %v", err)
+	}
+
+	if records != 1 {
+		t.Fatalf("combined log has %d records, want 1", records)
+	}
+	if len(muts) != 2 {
+		t.Fatalf("combined record has %d mutations, want 2", len(muts))
+	}
+}
+
+// TestReplayTxnLogRedoesMutations checks a fresh Store replays every
+// mutation a prior Store committed through the combined log.
+func TestReplayTxnLogRedoesMutations(t *testing.T) {
+	dir := t.TempDir()
+
+	s1 := NewStore()
+	if err := s1.EnableTxnLog(dir); err != nil {
+		t.Fatalf("EnableTxnLog: %v", err)
+	}
+	txn, err := s1.Begin(false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := txn.PutInode(&Inode{Inode: 7}); err != nil {
+		t.Fatalf("PutInode: %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	s2 := NewStore()
+	if err := s2.ReplayTxnLog(dir); err != nil {
+		t.Fatalf("ReplayTxnLog: %v", err)
+	}
+	if !s2.Inode.BTree.Has(&Inode{Inode: 7}) {
+		t.Fatalf("inode 7 missing after ReplayTxnLog")
+	}
+}
+
+// TestReplayTxnLogSkipsMutationsOlderThanTree checks ReplayTxnLog does not
+// regress a tree to a stale Txn-era value: a key committed once via Txn and
+// later overwritten by an ordinary, non-Txn Put on the same tree (which
+// never touches the combined log at all) must keep the newer value after
+// the combined log is replayed on top of the tree's own LoadWAL state.
+func TestReplayTxnLogSkipsMutationsOlderThanTree(t *testing.T) {
+	dir := t.TempDir()
+
+	s1 := NewStore()
+	if err := s1.EnableTxnLog(dir); err != nil {
+		t.Fatalf("EnableTxnLog: %v", err)
+	}
+	s1.Inode.BTree.SetApplyID(1)
+	txn, err := s1.Begin(false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := txn.PutInode(&Inode{Inode: 7, Uid: 1}); err != nil {
+		t.Fatalf("PutInode: %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// A later, non-Txn Put on the same tree: never appears in the combined
+	// log, only in the Inode tree's own WAL.
+	if err := s1.Inode.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL: %v", err)
+	}
+	s1.Inode.BTree.SetApplyID(2)
+	if err := s1.Inode.Put(&Inode{Inode: 7, Uid: 2}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s1.Inode.BTree.wal.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	s2 := NewStore()
+	if err := s2.Inode.LoadWAL(dir); err != nil {
+		t.Fatalf("LoadWAL: %v", err)
+	}
+	if err := s2.ReplayTxnLog(dir); err != nil {
+		t.Fatalf("ReplayTxnLog: %v", err)
+	}
+
+	got, err := s2.Inode.Get(7)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Uid != 2 {
+		t.Fatalf("inode 7 has Uid %d after replay, want 2 (the newer, non-Txn value)", got.Uid)
+	}
+}